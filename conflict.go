@@ -0,0 +1,367 @@
+package generic
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// Conflict is a single reason a rewritten package would not be safe to
+// write out: a substituted type no longer satisfies an interface it was
+// assigned to, or a renamed identifier collides with an existing
+// declaration.
+type Conflict struct {
+	Pos     token.Position
+	Message string
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s: %s", c.Pos, c.Message)
+}
+
+// ConflictError reports every Conflict found while pre-checking a rewrite,
+// so go:generate users see the full list of problems up front instead of a
+// downstream compile failure with the generated AST dumped to stderr.
+type ConflictError struct {
+	Conflicts []Conflict
+}
+
+func (e *ConflictError) Error() string {
+	msgs := make([]string, len(e.Conflicts))
+	for i, c := range e.Conflicts {
+		msgs[i] = c.String()
+	}
+	return fmt.Sprintf("generic: found %d conflict(s):\n%s", len(e.Conflicts), strings.Join(msgs, "\n"))
+}
+
+// assignabilityAndShadowConflicts runs the two checks that need to see the
+// package before the fix pipeline (remove-type-decl, rewrite-ident) has
+// mutated it: assignabilityConflicts looks for a `type TypeXXX ...`
+// GenDecl/TypeSpec still named after a typeMap key, and shadowConflicts
+// looks for declarations that would collide with a placeholder's Target
+// identifier once renamed. Call this on the package's pristine syntax
+// before runFixes runs - once remove-type-decl has deleted the placeholder
+// declaration, there is nothing left for either check to key off of, and
+// they silently report zero conflicts.
+//
+// imp resolves each Target's package so its replacement type can be
+// inspected with types.Implements.
+//
+// Both checks only make sense for OutputMonomorphized: they judge a
+// concrete Target against the interfaces and names the placeholder it
+// replaces had to satisfy. OutputGeneric never substitutes a concrete
+// Target - the placeholder becomes a type parameter instead - so this is a
+// no-op for it.
+func assignabilityAndShadowConflicts(fset *token.FileSet, files []*ast.File, info *types.Info, typeMap map[string]Target, targetObj map[types.Object]Target, imp types.Importer, output OutputMode) ([]Conflict, error) {
+	if output == OutputGeneric {
+		return nil, nil
+	}
+
+	var conflicts []Conflict
+	assignConflicts, err := assignabilityConflicts(fset, files, info, typeMap, imp)
+	if err != nil {
+		return nil, err
+	}
+	conflicts = append(conflicts, assignConflicts...)
+	conflicts = append(conflicts, shadowConflicts(fset, files, info, targetObj)...)
+	return conflicts, nil
+}
+
+// conflictError wraps conflicts as a *ConflictError, or returns nil if
+// conflicts is empty.
+func conflictError(conflicts []Conflict) error {
+	if len(conflicts) == 0 {
+		return nil
+	}
+	return &ConflictError{Conflicts: conflicts}
+}
+
+// assignabilityConflicts finds every interface a typeMap placeholder was
+// assigned to in the original package - via a plain assignment, a
+// function-argument pass, a return statement, or an explicit conversion -
+// and checks that the replacement Target still implements it. A generic
+// package that compiled against `type TypeXXX interface{ M() }` can easily
+// fail to compile once TypeXXX becomes a concrete Target that forgot to
+// implement M.
+func assignabilityConflicts(fset *token.FileSet, files []*ast.File, info *types.Info, typeMap map[string]Target, imp types.Importer) ([]Conflict, error) {
+	placeholderKey := make(map[types.Object]string)
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			genDecl, ok := decl.(*ast.GenDecl)
+			if !ok || genDecl.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range genDecl.Specs {
+				typeSpec := spec.(*ast.TypeSpec)
+				if _, ok := typeMap[typeSpec.Name.Name]; !ok {
+					continue
+				}
+				if obj := info.Defs[typeSpec.Name]; obj != nil {
+					placeholderKey[obj] = typeSpec.Name.Name
+				}
+			}
+		}
+	}
+
+	// key -> distinct interfaces it was assigned to, keyed by the
+	// *types.Interface identity so the same interface seen at several call
+	// sites is only reported once, at its first occurrence.
+	ifaces := make(map[string]map[*types.Interface]token.Pos)
+	record := func(key string, t types.Type, pos token.Pos) {
+		if t == nil {
+			return
+		}
+		iface, ok := t.Underlying().(*types.Interface)
+		if !ok || iface.NumMethods() == 0 {
+			return
+		}
+		if ifaces[key] == nil {
+			ifaces[key] = make(map[*types.Interface]token.Pos)
+		}
+		if _, ok := ifaces[key][iface]; !ok {
+			ifaces[key][iface] = pos
+		}
+	}
+	// placeholderType mirrors placeholderKey but keyed by the placeholder's
+	// *types.Type rather than its *types.TypeName object, so placeholderOf
+	// can match any expression whose type is the placeholder - not just a
+	// bare reference to the placeholder identifier itself. An assignment's
+	// RHS, a call argument, or a return value is ordinarily a value of the
+	// placeholder type, not the type's own identifier, so matching on
+	// info.Uses (which only ever resolves to the *types.TypeName) missed
+	// every one of those in practice.
+	placeholderType := make(map[string]types.Type)
+	for obj, key := range placeholderKey {
+		placeholderType[key] = obj.Type()
+	}
+	placeholderOf := func(e ast.Expr) (string, bool) {
+		t := info.TypeOf(e)
+		if t == nil {
+			return "", false
+		}
+		for key, pt := range placeholderType {
+			if types.Identical(t, pt) {
+				return key, true
+			}
+		}
+		return "", false
+	}
+
+	for _, f := range files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch x := n.(type) {
+			case *ast.AssignStmt:
+				for i, rhs := range x.Rhs {
+					if i >= len(x.Lhs) {
+						break
+					}
+					key, ok := placeholderOf(rhs)
+					if !ok {
+						continue
+					}
+					record(key, info.TypeOf(x.Lhs[i]), x.Pos())
+				}
+			case *ast.CallExpr:
+				if ident, ok := x.Fun.(*ast.Ident); ok && len(x.Args) == 1 {
+					// A conversion T(v): record v's assignment to T.
+					if key, ok := placeholderOf(x.Args[0]); ok {
+						record(key, info.TypeOf(ident), x.Pos())
+					}
+				}
+				sig, _ := info.TypeOf(x.Fun).(*types.Signature)
+				if sig != nil {
+					for i, arg := range x.Args {
+						key, ok := placeholderOf(arg)
+						if !ok || i >= sig.Params().Len() {
+							continue
+						}
+						record(key, sig.Params().At(i).Type(), arg.Pos())
+					}
+				}
+			case *ast.ReturnStmt:
+				// Each result is assigned to the enclosing function's result type.
+				var sig *types.Signature
+				path, _ := astutil.PathEnclosingInterval(f, x.Pos(), x.End())
+				for i := 0; i < len(path) && sig == nil; i++ {
+					switch fn := path[i].(type) {
+					case *ast.FuncLit:
+						sig, _ = info.TypeOf(fn).(*types.Signature)
+					case *ast.FuncDecl:
+						sig, _ = info.Defs[fn.Name].Type().(*types.Signature)
+					}
+				}
+				for i, result := range x.Results {
+					if key, ok := placeholderOf(result); ok && sig != nil && i < sig.Results().Len() {
+						record(key, sig.Results().At(i).Type(), result.Pos())
+					}
+				}
+			}
+			return true
+		})
+	}
+
+	var conflicts []Conflict
+	for key, set := range ifaces {
+		to, ok := typeMap[key]
+		if !ok {
+			continue
+		}
+		targetType, err := lookupTargetType(imp, to)
+		if err != nil {
+			return nil, err
+		}
+		if targetType == nil {
+			continue
+		}
+		for iface, pos := range set {
+			if types.Implements(targetType, iface) || types.Implements(types.NewPointer(targetType), iface) {
+				continue
+			}
+			conflicts = append(conflicts, Conflict{
+				Pos:     fset.Position(pos),
+				Message: fmt.Sprintf("%s (replacing %s) does not implement %s", to.Ident, key, iface.String()),
+			})
+		}
+	}
+	return conflicts, nil
+}
+
+// lookupTargetType resolves a Target's package and looks up its Ident to
+// get the types.Type that was substituted in, so it can be checked against
+// an interface with types.Implements.
+func lookupTargetType(imp types.Importer, to Target) (types.Type, error) {
+	if to.Import == "" {
+		return nil, nil
+	}
+	pkg, err := imp.Import(to.Import)
+	if err != nil {
+		return nil, err
+	}
+	obj := pkg.Scope().Lookup(to.Ident)
+	if obj == nil {
+		return nil, nil
+	}
+	return obj.Type(), nil
+}
+
+// shadowConflicts finds declarations in the rewritten files that are not
+// themselves one of typeMap's replacements but happen to share a
+// replacement's name - rewriteIdent would rename every use of the
+// placeholder to that name, so such a declaration would silently shadow it
+// within its scope.
+func shadowConflicts(fset *token.FileSet, files []*ast.File, info *types.Info, targetObj map[types.Object]Target) []Conflict {
+	names := make(map[string]bool)
+	for _, to := range targetObj {
+		names[to.Ident] = true
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	var conflicts []Conflict
+	for _, f := range files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			ident, ok := n.(*ast.Ident)
+			if !ok {
+				return true
+			}
+			obj := info.Defs[ident]
+			if obj == nil {
+				return true
+			}
+			if _, isReplacement := targetObj[obj]; isReplacement {
+				return true
+			}
+			if names[ident.Name] {
+				conflicts = append(conflicts, Conflict{
+					Pos:     fset.Position(ident.Pos()),
+					Message: fmt.Sprintf("declaration %q shadows a replacement identifier of the same name", ident.Name),
+				})
+			}
+			return true
+		})
+	}
+	return conflicts
+}
+
+// destCollisions finds top-level identifiers emitted by rewriteTopLevelIdent
+// that already exist in the destination directory's package, which is the
+// way callers end up with an unreadable "redeclared in this block" error
+// from the Go compiler instead of an actionable message from this package.
+func destCollisions(fset *token.FileSet, files, destFiles []*ast.File) []Conflict {
+	if len(destFiles) == 0 {
+		return nil
+	}
+	existing := make(map[string]bool)
+	for _, f := range destFiles {
+		for _, name := range topLevelNames(f) {
+			existing[name] = true
+		}
+	}
+
+	var conflicts []Conflict
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Recv == nil && existing[decl.Name.Name] {
+					conflicts = append(conflicts, Conflict{
+						Pos:     fset.Position(decl.Name.Pos()),
+						Message: fmt.Sprintf("%q already declared in destination package", decl.Name.Name),
+					})
+				}
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					switch spec := spec.(type) {
+					case *ast.TypeSpec:
+						if existing[spec.Name.Name] {
+							conflicts = append(conflicts, Conflict{
+								Pos:     fset.Position(spec.Name.Pos()),
+								Message: fmt.Sprintf("%q already declared in destination package", spec.Name.Name),
+							})
+						}
+					case *ast.ValueSpec:
+						for _, ident := range spec.Names {
+							if existing[ident.Name] {
+								conflicts = append(conflicts, Conflict{
+									Pos:     fset.Position(ident.Pos()),
+									Message: fmt.Sprintf("%q already declared in destination package", ident.Name),
+								})
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return conflicts
+}
+
+// topLevelNames lists the names a file declares at package scope.
+func topLevelNames(f *ast.File) []string {
+	var names []string
+	for _, decl := range f.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Recv == nil {
+				names = append(names, decl.Name.Name)
+			}
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					names = append(names, spec.Name.Name)
+				case *ast.ValueSpec:
+					for _, ident := range spec.Names {
+						names = append(names, ident.Name)
+					}
+				}
+			}
+		}
+	}
+	return names
+}
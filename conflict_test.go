@@ -0,0 +1,104 @@
+package generic
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"testing"
+)
+
+// TestAssignabilityConflicts verifies that a placeholder assigned to an
+// interface is flagged once its typeMap replacement stops implementing
+// that interface, across each of the flows the request named: a plain
+// assignment, a function-argument pass, and a return statement.
+//
+// RewritePackageWithConfig must call this against the package's pristine
+// syntax, before the fix pipeline's remove-type-decl/rewrite-ident steps
+// delete the placeholder's declaration and rename its uses - run it
+// afterward instead and placeholderKey stays empty, so it silently
+// reports zero conflicts no matter what the replacement is.
+//
+// placeholderOf resolves each flow's operand by info.TypeOf, not by
+// requiring the operand itself to be a bare reference to the placeholder
+// identifier (info.Uses) - `Use(v)`, `i = v`, and `return v`
+// all pass a TypeXXX-typed value, never the TypeXXX identifier itself, so
+// matching on identifier identity missed every one of them.
+func TestAssignabilityConflicts(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{
+			name: "function-argument pass",
+			src: `package p
+
+type TypeXXX interface{ M() }
+
+func Use(x TypeXXX) {}
+
+func Call() {
+	var v TypeXXX
+	Use(v)
+}
+`,
+		},
+		{
+			name: "plain assignment",
+			src: `package p
+
+type TypeXXX interface{ M() }
+
+func Call() {
+	var v TypeXXX
+	var i TypeXXX
+	i = v
+	_ = i
+}
+`,
+		},
+		{
+			name: "return statement",
+			src: `package p
+
+type TypeXXX interface{ M() }
+
+func Make() TypeXXX {
+	var v TypeXXX
+	return v
+}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fset := token.NewFileSet()
+			file, err := parser.ParseFile(fset, "p.go", tt.src, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := &types.Info{
+				Defs:  make(map[*ast.Ident]types.Object),
+				Uses:  make(map[*ast.Ident]types.Object),
+				Types: make(map[ast.Expr]types.TypeAndValue),
+			}
+			conf := types.Config{Importer: importer.Default()}
+			if _, err := conf.Check("p", fset, []*ast.File{file}, info); err != nil {
+				t.Fatal(err)
+			}
+
+			// bytes.Buffer does not implement interface{ M() }.
+			typeMap := map[string]Target{"TypeXXX": {Ident: "Buffer", Import: "bytes"}}
+
+			conflicts, err := assignabilityConflicts(fset, []*ast.File{file}, info, typeMap, importer.Default())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(conflicts) != 1 {
+				t.Fatalf("assignabilityConflicts() = %v, want exactly 1 conflict", conflicts)
+			}
+		})
+	}
+}
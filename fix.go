@@ -0,0 +1,95 @@
+package generic
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+)
+
+// Fix is a single named AST rewrite step, modeled on the fix table
+// golang.org/x/tools/cmd/aefix drives its rewrites from: it reports whether
+// it changed file, so runFixes can tell when a fixed point has been
+// reached.
+//
+// params carries whatever a Fix needs to do its work. The built-in fixes
+// read from it by key:
+//
+//	"pkgName"   string                   - new package name ("pkgname")
+//	"typeMap"   map[string]Target        - placeholders being replaced ("remove-type-decl", "prefix-toplevel")
+//	"targetObj" map[types.Object]Target  - targetObjects(...) result ("rewrite-ident")
+//	"prefix"    string                   - new import path's suffix ("prefix-toplevel")
+//
+// A caller-registered Fix is free to read its own keys out of params
+// instead; RewritePackageWithConfig always populates the keys above, so a
+// custom Fix can combine them with its own.
+type Fix func(fset *token.FileSet, file *ast.File, info *types.Info, params map[string]any) (changed bool, err error)
+
+// fixes is the registry RegisterFix adds to and Options.Fixes selects from
+// by name.
+var fixes = map[string]Fix{}
+
+// RegisterFix adds a named Fix to the registry, so it can be listed in
+// Options.Fixes without forking this package - e.g. to rename methods,
+// inject a build tag, or turn interface{} into any as part of the same
+// rewrite. Registering a name that already exists replaces the previous
+// Fix.
+func RegisterFix(name string, f Fix) {
+	fixes[name] = f
+}
+
+func init() {
+	RegisterFix("pkgname", fixPkgName)
+	RegisterFix("remove-type-decl", fixRemoveTypeDecl)
+	RegisterFix("rewrite-ident", fixRewriteIdent)
+	RegisterFix("prefix-toplevel", fixPrefixToplevel)
+}
+
+func fixPkgName(fset *token.FileSet, file *ast.File, info *types.Info, params map[string]any) (bool, error) {
+	name, _ := params["pkgName"].(string)
+	if name == "" {
+		return false, nil
+	}
+	return rewritePkgName(file, name), nil
+}
+
+func fixRemoveTypeDecl(fset *token.FileSet, file *ast.File, info *types.Info, params map[string]any) (bool, error) {
+	typeMap, _ := params["typeMap"].(map[string]Target)
+	return removeTypeDecl(file, typeMap), nil
+}
+
+func fixRewriteIdent(fset *token.FileSet, file *ast.File, info *types.Info, params map[string]any) (bool, error) {
+	targetObj, _ := params["targetObj"].(map[types.Object]Target)
+	return rewriteIdent(file, targetObj, info, fset), nil
+}
+
+func fixPrefixToplevel(fset *token.FileSet, file *ast.File, info *types.Info, params map[string]any) (bool, error) {
+	prefix, _ := params["prefix"].(string)
+	typeMap, _ := params["typeMap"].(map[string]Target)
+	return rewriteTopLevelIdent(file, prefix, typeMap, info), nil
+}
+
+// runFixes applies the named fixes to file in order, repeating the full
+// sequence until a pass makes no further change - the same fixed point
+// aefix's main.go drives its own fix table to, since a later fix (e.g. a
+// caller-registered one) may expose something an earlier one can now act
+// on.
+func runFixes(fset *token.FileSet, file *ast.File, info *types.Info, names []string, params map[string]any) error {
+	for {
+		changedAny := false
+		for _, name := range names {
+			fix, ok := fixes[name]
+			if !ok {
+				return fmt.Errorf("generic: unknown fix %q", name)
+			}
+			changed, err := fix(fset, file, info, params)
+			if err != nil {
+				return fmt.Errorf("generic: fix %q: %w", name, err)
+			}
+			changedAny = changedAny || changed
+		}
+		if !changedAny {
+			return nil
+		}
+	}
+}
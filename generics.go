@@ -0,0 +1,272 @@
+package generic
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+)
+
+// OutputMode selects the shape RewritePackage's output takes.
+type OutputMode int
+
+const (
+	// OutputMonomorphized is the default: every typeMap placeholder is
+	// substituted with its concrete Target throughout the package, the way
+	// RewritePackage always has. Callers get one non-generic copy per call.
+	OutputMonomorphized OutputMode = iota
+
+	// OutputGeneric turns each typeMap placeholder into a Go 1.18+ type
+	// parameter on every function, method, and type that mentions it,
+	// instead of substituting a concrete Target. Callers get a single
+	// generic package rather than N monomorphized copies, at the cost of
+	// requiring a 1.18+ toolchain to build it.
+	OutputGeneric
+)
+
+// Options configures RewritePackage. The zero Options behaves exactly like
+// RewritePackage has always behaved.
+type Options struct {
+	// Output selects the shape of the rewritten package.
+	Output OutputMode
+
+	// Fixes lists additional Fix names, registered with RegisterFix, to run
+	// in the same fixed-point pass as the built-in rewrite pipeline - for
+	// example to rename methods, inject a build tag, or convert
+	// interface{} to any without forking this package.
+	Fixes []string
+}
+
+// placeholderConstraints finds every `type TypeXXX Constraint` declaration
+// named in typeMap and returns Constraint as the ast.Expr a type parameter
+// for TypeXXX should carry. findDecl (used elsewhere to build a same-dir
+// type-check skeleton) replaces every such declaration's RHS with a uint32
+// dummy regardless of what it originally said; mirror its notion of "no
+// real constraint" by mapping that dummy to `any`, but keep the real
+// expression for declarations that spell out an actual interface.
+func placeholderConstraints(node *ast.File, typeMap map[string]Target) map[string]ast.Expr {
+	exprs := make(map[string]ast.Expr)
+	for _, decl := range node.Decls {
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range genDecl.Specs {
+			typeSpec := spec.(*ast.TypeSpec)
+			if _, ok := typeMap[typeSpec.Name.Name]; !ok {
+				continue
+			}
+			if ident, ok := typeSpec.Type.(*ast.Ident); ok && ident.Name == "uint32" {
+				exprs[typeSpec.Name.Name] = ast.NewIdent("any")
+				continue
+			}
+			exprs[typeSpec.Name.Name] = typeSpec.Type
+		}
+	}
+	return exprs
+}
+
+// placeholderTypeObjects finds every `type TypeXXX ...` declaration named in
+// typeMap and returns the *types.TypeName go/types recorded for it, keyed
+// by that object rather than by name - the same identity rewriteIdent and
+// targetObjects key off of, so an unrelated local variable that happens to
+// share a placeholder's name is never confused with the placeholder
+// itself.
+func placeholderTypeObjects(node *ast.File, typeMap map[string]Target, info *types.Info) map[types.Object]string {
+	objs := make(map[types.Object]string)
+	for _, decl := range node.Decls {
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range genDecl.Specs {
+			typeSpec := spec.(*ast.TypeSpec)
+			if _, ok := typeMap[typeSpec.Name.Name]; !ok {
+				continue
+			}
+			if obj := info.Defs[typeSpec.Name]; obj != nil {
+				objs[obj] = typeSpec.Name.Name
+			}
+		}
+	}
+	return objs
+}
+
+// mentionedPlaceholders lists, in a stable order, which of objs' names are
+// denoted by an identifier somewhere in n, resolved through info.Uses and
+// info.Defs rather than by comparing identifier spelling - the same
+// go/types-driven lookup rewriteIdent uses, so a local var, parameter, or
+// unrelated declaration that merely happens to share a placeholder's name
+// is left alone instead of wrongly parameterizing its enclosing func.
+// Uses is checked before Defs so an embedded field's identifier (type
+// Wrapper struct { TypeXXX }) - which go/types records in both maps, Defs
+// as the implicit field *Var it introduces and Uses as the *TypeName it
+// denotes - is recognized by the TypeName, not missed because the field
+// Var shadowed it.
+// Callers must pass the whole declaration - e.g. a *ast.FuncDecl, not just
+// its .Type - or a mention confined to a function body (a local var, a
+// conversion, a composite literal) is missed, the enclosing func gets no
+// type parameter, and rewriteGeneric still deletes the placeholder's
+// declaration out from under it.
+func mentionedPlaceholders(n ast.Node, objs map[types.Object]string, info *types.Info) []string {
+	if n == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var used []string
+	ast.Inspect(n, func(n ast.Node) bool {
+		ident, ok := n.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		obj := info.Uses[ident]
+		if obj == nil {
+			obj = info.Defs[ident]
+		}
+		if obj == nil {
+			return true
+		}
+		name, ok := objs[obj]
+		if !ok || seen[name] {
+			return true
+		}
+		seen[name] = true
+		used = append(used, name)
+		return true
+	})
+	sort.Strings(used)
+	return used
+}
+
+// typeParamFields builds the [names... Constraint] field list for a
+// FuncDecl.Type.TypeParams or TypeSpec.TypeParams.
+func typeParamFields(names []string, constraints map[string]ast.Expr) *ast.FieldList {
+	fields := make([]*ast.Field, len(names))
+	for i, name := range names {
+		fields[i] = &ast.Field{
+			Names: []*ast.Ident{ast.NewIdent(name)},
+			Type:  constraints[name],
+		}
+	}
+	return &ast.FieldList{List: fields}
+}
+
+// recvBase splits a method receiver's type expression into the declared
+// type's name and whether the receiver is a pointer to it.
+func recvBase(expr ast.Expr) (name string, ptr bool) {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+		ptr = true
+	}
+	if ident, ok := expr.(*ast.Ident); ok {
+		name = ident.Name
+	}
+	return name, ptr
+}
+
+// indexExpr builds the T[A] or T[A, B] instantiation expression a method
+// receiver needs once T becomes generic.
+func indexExpr(x ast.Expr, names []string) ast.Expr {
+	indices := make([]ast.Expr, len(names))
+	for i, name := range names {
+		indices[i] = ast.NewIdent(name)
+	}
+	if len(indices) == 1 {
+		return &ast.IndexExpr{X: x, Index: indices[0]}
+	}
+	return &ast.IndexListExpr{X: x, Indices: indices}
+}
+
+// rewriteGeneric converts typeMap's placeholder type declarations into
+// type parameters on every top-level function, type, and method that
+// mentions them, as an alternative to removeTypeDecl+rewriteIdent's
+// monomorphizing substitution.
+//
+// The placeholder identifiers themselves are never renamed: dropping their
+// global `type TypeXXX ...` declaration and introducing a type parameter of
+// the same name on the enclosing func or type is enough for every existing
+// use within that scope to bind to the new type parameter instead, by
+// ordinary Go lexical scoping.
+//
+// info is the package's go/types.Info, used (via placeholderTypeObjects and
+// mentionedPlaceholders) to tell a genuine mention of a placeholder from an
+// unrelated identifier that merely shares its name - the same shadowing
+// hazard chunk0-1 eliminated for the monomorphizing path.
+func rewriteGeneric(node *ast.File, typeMap map[string]Target, info *types.Info) {
+	constraints := placeholderConstraints(node, typeMap)
+	if len(constraints) == 0 {
+		return
+	}
+	objs := placeholderTypeObjects(node, typeMap, info)
+
+	// mentions records, for each top-level type whose declaration just
+	// became generic, which placeholder names it was parameterized over -
+	// its methods need a matching receiver instantiation below.
+	mentions := make(map[string][]string)
+
+	for _, decl := range node.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Recv != nil {
+				continue // handled in the receiver pass, below.
+			}
+			used := mentionedPlaceholders(decl, objs, info)
+			if len(used) > 0 {
+				decl.Type.TypeParams = typeParamFields(used, constraints)
+			}
+		case *ast.GenDecl:
+			if decl.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range decl.Specs {
+				typeSpec := spec.(*ast.TypeSpec)
+				if _, ok := constraints[typeSpec.Name.Name]; ok {
+					continue // the placeholder's own declaration is dropped below.
+				}
+				used := mentionedPlaceholders(typeSpec.Type, objs, info)
+				if len(used) == 0 {
+					continue
+				}
+				typeSpec.TypeParams = typeParamFields(used, constraints)
+				mentions[typeSpec.Name.Name] = used
+			}
+		}
+	}
+
+	// Every method of a type that became generic must repeat its type
+	// parameter names on the receiver, whether or not that particular
+	// method's body mentions them.
+	for _, decl := range node.Decls {
+		funcDecl, ok := decl.(*ast.FuncDecl)
+		if !ok || funcDecl.Recv == nil || len(funcDecl.Recv.List) == 0 {
+			continue
+		}
+		base, ptr := recvBase(funcDecl.Recv.List[0].Type)
+		used, ok := mentions[base]
+		if !ok {
+			continue
+		}
+		instantiated := indexExpr(ast.NewIdent(base), used)
+		if ptr {
+			instantiated = &ast.StarExpr{X: instantiated}
+		}
+		funcDecl.Recv.List[0].Type = instantiated
+	}
+
+	// Drop each placeholder's own declaration, whatever its RHS.
+	for i := len(node.Decls) - 1; i >= 0; i-- {
+		genDecl, ok := node.Decls[i].(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.TYPE {
+			continue
+		}
+		specs := genDecl.Specs[:0]
+		for _, spec := range genDecl.Specs {
+			if _, ok := constraints[spec.(*ast.TypeSpec).Name.Name]; !ok {
+				specs = append(specs, spec)
+			}
+		}
+		if genDecl.Specs = specs; len(specs) == 0 {
+			node.Decls = append(node.Decls[:i], node.Decls[i+1:]...)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package generic
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"testing"
+)
+
+// typeCheck parses and type-checks src, returning the *ast.File and the
+// *types.Info rewriteGeneric needs to resolve identifiers by object
+// identity rather than by name.
+func typeCheck(t *testing.T, fset *token.FileSet, src string) (*ast.File, *types.Info) {
+	t.Helper()
+	file, err := parser.ParseFile(fset, "p.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &types.Info{
+		Defs:  make(map[*ast.Ident]types.Object),
+		Uses:  make(map[*ast.Ident]types.Object),
+		Types: make(map[ast.Expr]types.TypeAndValue),
+	}
+	conf := types.Config{Importer: importer.Default()}
+	if _, err := conf.Check("p", fset, []*ast.File{file}, info); err != nil {
+		t.Fatal(err)
+	}
+	return file, info
+}
+
+// TestRewriteGenericBodyOnlyMention verifies that a placeholder mentioned
+// only inside a function body - not its signature - still gets the
+// function parameterized. mentionedPlaceholders used to be handed just
+// decl.Type, so a body-only use like a local var declaration was invisible
+// to it: the function kept no type parameter, yet removeTypeDecl still
+// dropped the placeholder's declaration, leaving a dangling identifier.
+func TestRewriteGenericBodyOnlyMention(t *testing.T) {
+	const src = `package p
+
+type TypeXXX uint32
+
+func Use() int {
+	var x TypeXXX
+	return int(x)
+}
+`
+	fset := token.NewFileSet()
+	file, info := typeCheck(t, fset, src)
+
+	typeMap := map[string]Target{"TypeXXX": {}}
+	rewriteGeneric(file, typeMap, info)
+
+	for _, decl := range file.Decls {
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range genDecl.Specs {
+			if spec.(*ast.TypeSpec).Name.Name == "TypeXXX" {
+				t.Fatal("rewriteGeneric left the TypeXXX declaration in place")
+			}
+		}
+	}
+
+	var use *ast.FuncDecl
+	for _, decl := range file.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Name.Name == "Use" {
+			use = fn
+		}
+	}
+	if use == nil {
+		t.Fatal("func Use not found")
+	}
+	if use.Type.TypeParams == nil || len(use.Type.TypeParams.List) != 1 {
+		t.Fatalf("Use.Type.TypeParams = %v, want one type parameter for its body-only TypeXXX use", use.Type.TypeParams)
+	}
+	if name := use.Type.TypeParams.List[0].Names[0].Name; name != "TypeXXX" {
+		t.Errorf("type parameter name = %q, want %q", name, "TypeXXX")
+	}
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, file); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("rewritten:\n%s", buf.String())
+}
+
+// TestRewriteGenericEmbeddedField verifies that a struct embedding a
+// placeholder directly (type Wrapper struct { TypeXXX }) is recognized as
+// mentioning it and gets parameterized. mentionedPlaceholders resolved an
+// identifier through info.Defs before info.Uses; for an embedded field
+// go/types sets both - Defs to the implicit field *Var it introduces,
+// Uses to the *TypeName it denotes - so checking Defs first matched the
+// field Var (never a placeholder) and Uses, the one that actually
+// identifies it as TypeXXX, was never consulted. The struct was left
+// un-parameterized while removeTypeDecl still deleted TypeXXX's
+// declaration out from under it.
+func TestRewriteGenericEmbeddedField(t *testing.T) {
+	const src = `package p
+
+type TypeXXX uint32
+
+type Wrapper struct {
+	TypeXXX
+}
+`
+	fset := token.NewFileSet()
+	file, info := typeCheck(t, fset, src)
+
+	typeMap := map[string]Target{"TypeXXX": {}}
+	rewriteGeneric(file, typeMap, info)
+
+	var wrapper *ast.TypeSpec
+	for _, decl := range file.Decls {
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range genDecl.Specs {
+			typeSpec := spec.(*ast.TypeSpec)
+			if typeSpec.Name.Name == "Wrapper" {
+				wrapper = typeSpec
+			}
+			if typeSpec.Name.Name == "TypeXXX" {
+				t.Fatal("rewriteGeneric left the TypeXXX declaration in place")
+			}
+		}
+	}
+	if wrapper == nil {
+		t.Fatal("type Wrapper not found")
+	}
+	if wrapper.TypeParams == nil || len(wrapper.TypeParams.List) != 1 {
+		t.Fatalf("Wrapper.TypeParams = %v, want one type parameter for its embedded TypeXXX field", wrapper.TypeParams)
+	}
+	if name := wrapper.TypeParams.List[0].Names[0].Name; name != "TypeXXX" {
+		t.Errorf("type parameter name = %q, want %q", name, "TypeXXX")
+	}
+}
+
+// TestRewriteGenericIgnoresShadowingIdent verifies that a function whose
+// body merely declares a local variable named after a placeholder - never
+// referring to the placeholder type itself - is left unparameterized.
+// mentionedPlaceholders used to match on ident.Name alone with no
+// types.Info in reach, so this local var (and the unrelated identifier it
+// introduces) was indistinguishable from a genuine TypeXXX mention.
+func TestRewriteGenericIgnoresShadowingIdent(t *testing.T) {
+	const src = `package p
+
+type TypeXXX uint32
+
+func Use() int {
+	var x TypeXXX
+	return int(x)
+}
+
+func Unrelated() int {
+	TypeXXX := 5
+	return TypeXXX
+}
+`
+	fset := token.NewFileSet()
+	file, info := typeCheck(t, fset, src)
+
+	typeMap := map[string]Target{"TypeXXX": {}}
+	rewriteGeneric(file, typeMap, info)
+
+	var use, unrelated *ast.FuncDecl
+	for _, decl := range file.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			switch fn.Name.Name {
+			case "Use":
+				use = fn
+			case "Unrelated":
+				unrelated = fn
+			}
+		}
+	}
+	if use == nil || unrelated == nil {
+		t.Fatal("Use or Unrelated func not found")
+	}
+	if use.Type.TypeParams == nil || len(use.Type.TypeParams.List) != 1 {
+		t.Fatalf("Use.Type.TypeParams = %v, want one type parameter for its genuine TypeXXX use", use.Type.TypeParams)
+	}
+	if unrelated.Type.TypeParams != nil {
+		t.Fatalf("Unrelated.Type.TypeParams = %v, want nil - its local var only shares TypeXXX's name", unrelated.Type.TypeParams)
+	}
+}
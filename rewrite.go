@@ -2,68 +2,130 @@
 package generic
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"go/ast"
 	"go/format"
-	"go/importer"
-	"go/parser"
 	"go/printer"
 	"go/token"
 	"go/types"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
 )
 
-// rewritePkgName sets current package name.
-func rewritePkgName(node *ast.File, pkgName string) {
+// rewritePkgName sets current package name. It reports whether the name
+// actually changed, so it can double as the "pkgname" Fix.
+func rewritePkgName(node *ast.File, pkgName string) bool {
+	if node.Name.Name == pkgName {
+		return false
+	}
 	node.Name.Name = pkgName
+	return true
 }
 
-// rewriteIdent converts TypeXXX to its replacement defined in typeMap.
-func rewriteIdent(node *ast.File, typeMap map[string]Target, fset *token.FileSet) {
-	var used []string
-	ast.Inspect(node, func(n ast.Node) bool {
-		switch x := n.(type) {
-		case *ast.Ident:
-			if x.Obj == nil || x.Obj.Kind != ast.Typ {
-				return false
-			}
-			to, ok := typeMap[x.Name]
-			if !ok {
-				return false
-			}
-			x.Name = to.Ident
-
-			if to.Import == "" {
-				return false
+// targetObjects maps each typeMap placeholder to the types.Object that
+// go/types assigned to its declaration, across every file of the package.
+//
+// Looking renames up by object identity, rather than by the deprecated
+// ast.Object links on *ast.Ident, is what lets rewriteIdent and
+// rewriteTopLevelIdent tell a placeholder type from an unrelated identifier
+// that merely shares its name (a local variable, a shadowing parameter, a
+// type of the same name in another file).
+func targetObjects(files []*ast.File, typeMap map[string]Target, info *types.Info) map[types.Object]Target {
+	objs := make(map[types.Object]Target)
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			genDecl, ok := decl.(*ast.GenDecl)
+			if !ok || genDecl.Tok != token.TYPE {
+				continue
 			}
-			var found bool
-			for _, im := range used {
-				if im == to.Import {
-					found = true
-					break
+			for _, spec := range genDecl.Specs {
+				typeSpec := spec.(*ast.TypeSpec)
+				to, ok := typeMap[typeSpec.Name.Name]
+				if !ok {
+					continue
+				}
+				if obj := info.Defs[typeSpec.Name]; obj != nil {
+					objs[obj] = to
 				}
 			}
-			if !found {
-				used = append(used, to.Import)
-			}
+		}
+	}
+	return objs
+}
+
+// rewriteIdent converts TypeXXX to its replacement defined in typeMap. It
+// reports whether anything changed, so it can double as the "rewrite-ident"
+// Fix and a later pass over an already-rewritten file is a no-op.
+//
+// Every identifier is resolved through info.Uses (and, for the declaring
+// ast.Ident itself, info.Defs) instead of the legacy x.Obj links, so
+// shadowed locals, method receivers, embedded fields, and type-parameter
+// references such as Foo[TypeKey] are all handled by the same lookup: if
+// go/types says the identifier denotes one of targetObj's objects, it gets
+// rewritten, and nothing else does.
+//
+// Uses is checked before Defs: for most declaring identifiers Defs is the
+// only entry, but an embedded field's identifier (type Wrapper struct {
+// TypeXXX }) is both - go/types records Defs as the implicit field *Var it
+// introduces and Uses as the *TypeName it denotes - and it is the TypeName
+// that identifies it as a placeholder mention needing a rename.
+func rewriteIdent(node *ast.File, targetObj map[types.Object]Target, info *types.Info, fset *token.FileSet) bool {
+	changed := false
+	var used []string
+	ast.Inspect(node, func(n ast.Node) bool {
+		ident, ok := n.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		obj := info.Uses[ident]
+		if obj == nil {
+			obj = info.Defs[ident]
+		}
+		if obj == nil {
+			return false
+		}
+		to, ok := targetObj[obj]
+		if !ok {
+			return false
+		}
+		if ident.Name != to.Ident {
+			ident.Name = to.Ident
+			changed = true
+		}
+
+		if to.Import == "" {
 			return false
 		}
-		return true
+		var found bool
+		for _, im := range used {
+			if im == to.Import {
+				found = true
+				break
+			}
+		}
+		if !found {
+			used = append(used, to.Import)
+		}
+		return false
 	})
 	for _, im := range used {
-		astutil.AddImport(fset, node, im)
+		if astutil.AddImport(fset, node, im) {
+			changed = true
+		}
 	}
+	return changed
 }
 
-// removeTypeDecl removes type declarations defined in typeMap.
-func removeTypeDecl(node *ast.File, typeMap map[string]Target) {
+// removeTypeDecl removes type declarations defined in typeMap. It reports
+// whether a declaration was actually removed, so it can double as the
+// "remove-type-decl" Fix.
+func removeTypeDecl(node *ast.File, typeMap map[string]Target) bool {
+	changed := false
 	for i := len(node.Decls) - 1; i >= 0; i-- {
 		genDecl, ok := node.Decls[i].(*ast.GenDecl)
 		if !ok {
@@ -90,8 +152,10 @@ func removeTypeDecl(node *ast.File, typeMap map[string]Target) {
 		}
 		if remove {
 			node.Decls = append(node.Decls[:i], node.Decls[i+1:]...)
+			changed = true
 		}
 	}
+	return changed
 }
 
 // findDecl finds type and related declarations.
@@ -123,38 +187,67 @@ func findDecl(node *ast.File) (ret []ast.Decl) {
 
 // rewriteTopLevelIdent adds a prefix to top-level identifiers and their uses.
 //
-// This prevents name conflicts when a package is rewritten to PWD.
-func rewriteTopLevelIdent(node *ast.File, prefix string, typeMap map[string]Target) {
+// This prevents name conflicts when a package is rewritten to PWD. It
+// reports whether anything changed, so it can double as the
+// "prefix-toplevel" Fix: an identifier that already carries prefix's marker
+// is left alone, so a later pass over an already-prefixed file is a no-op.
+//
+// Declarations and uses are linked through info.Defs/info.Uses rather than
+// x.Obj, for the same reason rewriteIdent is: the legacy resolver cannot be
+// trusted to have seen every use correctly.
+func rewriteTopLevelIdent(node *ast.File, prefix string, typeMap map[string]Target, info *types.Info) bool {
+	changed := false
+	marker := prefix + "_"
+	alreadyPrefixed := func(name string) bool {
+		return strings.HasPrefix(name, marker)
+	}
 	prefixIdent := func(name string) string {
 		return lintName(fmt.Sprintf("%s_%s", prefix, name))
 	}
 
-	declMap := make(map[interface{}]string)
+	declMap := make(map[types.Object]string)
 	for _, decl := range node.Decls {
 		switch decl := decl.(type) {
 		case *ast.FuncDecl:
 			if decl.Recv != nil {
 				continue
 			}
-			decl.Name.Name = prefixIdent(decl.Name.Name)
-			declMap[decl] = decl.Name.Name
+			obj := info.Defs[decl.Name]
+			if !alreadyPrefixed(decl.Name.Name) {
+				decl.Name.Name = prefixIdent(decl.Name.Name)
+				changed = true
+			}
+			if obj != nil {
+				declMap[obj] = decl.Name.Name
+			}
 		case *ast.GenDecl:
 			for _, spec := range decl.Specs {
 				switch spec := spec.(type) {
 				case *ast.TypeSpec:
-					obj := spec.Name.Obj
-					if obj != nil && obj.Kind == ast.Typ {
-						if to, ok := typeMap[obj.Name]; ok && spec.Name.Name == to.Ident {
+					obj := info.Defs[spec.Name]
+					if obj != nil {
+						if to, ok := typeMap[obj.Name()]; ok && spec.Name.Name == to.Ident {
 							// If this identifier is already rewritten before, we don't need to prefix it.
 							continue
 						}
 					}
-					spec.Name.Name = prefixIdent(spec.Name.Name)
-					declMap[spec] = spec.Name.Name
+					if !alreadyPrefixed(spec.Name.Name) {
+						spec.Name.Name = prefixIdent(spec.Name.Name)
+						changed = true
+					}
+					if obj != nil {
+						declMap[obj] = spec.Name.Name
+					}
 				case *ast.ValueSpec:
 					for _, ident := range spec.Names {
-						ident.Name = prefixIdent(ident.Name)
-						declMap[spec] = ident.Name
+						obj := info.Defs[ident]
+						if !alreadyPrefixed(ident.Name) {
+							ident.Name = prefixIdent(ident.Name)
+							changed = true
+						}
+						if obj != nil {
+							declMap[obj] = ident.Name
+						}
 					}
 				}
 			}
@@ -163,45 +256,89 @@ func rewriteTopLevelIdent(node *ast.File, prefix string, typeMap map[string]Targ
 
 	// After top-level identifiers are renamed, find where they are used, and rewrite those.
 	ast.Inspect(node, func(n ast.Node) bool {
-		switch x := n.(type) {
-		case *ast.Ident:
-			if x.Obj == nil || x.Obj.Decl == nil {
-				return false
-			}
-			name, ok := declMap[x.Obj.Decl]
-			if !ok {
-				return false
-			}
-			x.Name = name
+		ident, ok := n.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		obj := info.Uses[ident]
+		if obj == nil {
 			return false
 		}
-		return true
+		name, ok := declMap[obj]
+		if !ok {
+			return false
+		}
+		if ident.Name != name {
+			ident.Name = name
+			changed = true
+		}
+		return false
 	})
+	return changed
 }
 
-// walkSource visits all .go files in a package path except tests.
-func walkSource(pkgPath string, sourceFunc func(string) error) error {
-	fi, err := ioutil.ReadDir(pkgPath)
+// loadMode is the minimum packages.Load mode RewritePackageWithConfig needs:
+// the syntax tree and the type-checking results driving the rewrite, plus
+// enough naming/import info to locate and print the package.
+const loadMode = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles |
+	packages.NeedSyntax | packages.NeedTypes | packages.NeedTypesInfo | packages.NeedImports
+
+// loadPackage loads the single package matching pattern, honoring the
+// caller's build tags, GOFLAGS, and go.work file through cfg. cfg may be
+// nil to use the package's own defaults. fset, if non-nil, is shared with
+// the load so that positions from two loadPackage calls (the root package
+// and, for a same-dir rewrite, ".") remain comparable.
+func loadPackage(cfg *packages.Config, fset *token.FileSet, pattern string) (*packages.Package, error) {
+	loadCfg := new(packages.Config)
+	if cfg != nil {
+		*loadCfg = *cfg
+	}
+	loadCfg.Mode |= loadMode
+	if fset != nil {
+		loadCfg.Fset = fset
+	}
+
+	pkgs, err := packages.Load(loadCfg, pattern)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for _, info := range fi {
-		if info.IsDir() {
-			continue
-		}
-		path := fmt.Sprintf("%s/%s", pkgPath, info.Name())
-		if !strings.HasSuffix(path, ".go") {
-			continue
-		}
-		if strings.HasSuffix(path, "_test.go") {
-			continue
-		}
-		err = sourceFunc(path)
-		if err != nil {
-			return err
-		}
+	if packages.PrintErrors(pkgs) > 0 {
+		return nil, fmt.Errorf("generic: errors loading package %q", pattern)
 	}
-	return nil
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("generic: pattern %q resolved to %d packages, want 1", pattern, len(pkgs))
+	}
+	return pkgs[0], nil
+}
+
+// packagesImporter resolves import paths through loadPackage (and so
+// through golang.org/x/tools/go/packages, honoring cfg's module/workspace
+// settings) instead of go/importer.Default, which only ever looks in
+// $GOPATH and can't see a module-based Target.Import. It backs the
+// post-rewrite type-check and the interface-satisfaction pre-check, the
+// two places a Target from another package in the same module needs to be
+// resolved.
+type packagesImporter struct {
+	cfg   *packages.Config
+	cache map[string]*types.Package
+}
+
+// newPackagesImporter returns a types.Importer scoped to cfg; cfg may be
+// nil to use loadPackage's defaults.
+func newPackagesImporter(cfg *packages.Config) *packagesImporter {
+	return &packagesImporter{cfg: cfg, cache: make(map[string]*types.Package)}
+}
+
+func (imp *packagesImporter) Import(path string) (*types.Package, error) {
+	if pkg, ok := imp.cache[path]; ok {
+		return pkg, nil
+	}
+	loaded, err := loadPackage(imp.cfg, nil, path)
+	if err != nil {
+		return nil, err
+	}
+	imp.cache[path] = loaded.Types
+	return loaded.Types, nil
 }
 
 type packageTarget struct {
@@ -228,72 +365,109 @@ func parsePackageTarget(path string) (*packageTarget, error) {
 	return t, nil
 }
 
-// RewritePackage applies type replacements on a package in GOPATH, and saves results as a new package in $PWD.
+// RewritePackage applies type replacements on a package and saves results
+// as a new package in $PWD. It is equivalent to RewritePackageWithConfig
+// with a nil *packages.Config.
 //
 // If there is a dir with the same name as newPkgPath, it will first be removed. It is possible to re-run this
 // to update a generic package.
-func RewritePackage(pkgPath string, newPkgPath string, typeMap map[string]Target) error {
+//
+// opts may be nil, which behaves like &Options{} - the default
+// OutputMonomorphized mode RewritePackage has always used.
+func RewritePackage(pkgPath string, newPkgPath string, typeMap map[string]Target, opts *Options) error {
+	return RewritePackageWithConfig(nil, pkgPath, newPkgPath, typeMap, opts)
+}
+
+// RewritePackageWithConfig is RewritePackage with an explicit
+// packages.Config, for callers that need to inject build tags, a GOFLAGS
+// value, or a custom Dir - for example to resolve pkgPath against a
+// particular module or to pick up a go.work file. cfg may be nil to use
+// RewritePackage's defaults.
+//
+// pkgPath is loaded through golang.org/x/tools/go/packages rather than
+// read straight out of $GOPATH/src, so it works under module mode,
+// vendored dependencies, and files gated by //go:build constraints.
+func RewritePackageWithConfig(cfg *packages.Config, pkgPath string, newPkgPath string, typeMap map[string]Target, opts *Options) error {
 	var err error
 
+	if opts == nil {
+		opts = &Options{}
+	}
+
 	pt, err := parsePackageTarget(newPkgPath)
 	if err != nil {
 		return err
 	}
 
-	fset := token.NewFileSet()
-	files := make(map[string]*ast.File)
-	err = walkSource(fmt.Sprintf("%s/src/%s", os.Getenv("GOPATH"), pkgPath), func(path string) error {
-		f, err := parser.ParseFile(fset, path, nil, 0)
-		if err != nil {
-			return err
-		}
-		files[path] = f
-		return nil
-	})
+	pkg, err := loadPackage(cfg, nil, pkgPath)
 	if err != nil {
 		return err
 	}
+	fset := pkg.Fset
+	astFiles := pkg.Syntax
+	info := pkg.TypesInfo
+	files := make(map[string]*ast.File, len(astFiles))
+	for i, f := range astFiles {
+		files[pkg.CompiledGoFiles[i]] = f
+	}
 
-	// Gather ast.File to create ast.Package.
-	// ast.NewPackage will try to resolve unresolved identifiers.
-	ast.NewPackage(fset, files, nil, nil)
+	postConf := types.Config{Importer: newPackagesImporter(cfg)}
 
-	// Apply AST changes and refresh.
-	buf := new(bytes.Buffer)
-	var tc []*ast.File
-	for path, f := range files {
-		rewritePkgName(f, pt.NewName)
-		removeTypeDecl(f, typeMap)
-		rewriteIdent(f, typeMap, fset)
-		if pt.SameDir {
-			rewriteTopLevelIdent(f, pt.NewPath, typeMap)
-		}
+	// assignabilityConflicts and shadowConflicts must run against the
+	// package's pristine syntax: remove-type-decl deletes the placeholder
+	// `type TypeXXX ...` declaration they key off of, so once the fix
+	// pipeline below has mutated astFiles (which, being the same *ast.File
+	// values as files, it mutates in place) there is nothing left for
+	// either check to find, and they would silently report zero conflicts.
+	targetObj := targetObjects(astFiles, typeMap, info)
+	preConflicts, err := assignabilityAndShadowConflicts(fset, astFiles, info, typeMap, targetObj, postConf.Importer, opts.Output)
+	if err != nil {
+		return err
+	}
 
-		// AST in dirty state; refresh
-		buf.Reset()
-		err = printer.Fprint(buf, fset, f)
-		if err != nil {
-			return err
+	// Apply AST changes. The built-in fixes reproduce the pipeline this
+	// package has always run; opts.Fixes lets a caller fold its own
+	// rewrites (registered with RegisterFix) into the same fixed-point
+	// pass instead of running as a separate step over the output.
+	names := []string{"pkgname"}
+	if opts.Output != OutputGeneric {
+		names = append(names, "remove-type-decl", "rewrite-ident")
+	}
+	if pt.SameDir {
+		names = append(names, "prefix-toplevel")
+	}
+	names = append(names, opts.Fixes...)
+	params := map[string]any{
+		"pkgName":   pt.NewName,
+		"typeMap":   typeMap,
+		"targetObj": targetObj,
+		"prefix":    pt.NewPath,
+	}
+
+	var tc []*ast.File
+	for _, f := range files {
+		if opts.Output == OutputGeneric {
+			rewriteGeneric(f, typeMap, info)
 		}
-		f, err = parser.ParseFile(fset, "", buf, 0)
-		if err != nil {
-			printer.Fprint(os.Stderr, fset, f)
+		if err := runFixes(fset, f, info, names, params); err != nil {
 			return err
 		}
-		files[path] = f
 		tc = append(tc, f)
 	}
 
-	// Type-check.
+	// Type-check the rewritten package to catch anything the substitution
+	// broke before it is written out.
+	var destFiles []*ast.File
 	if pt.SameDir {
 		// Also include same-dir files.
 		// However, it is silly to add the entire file,
 		// because that file might have identifiers from another generic package.
-		err = walkSource(".", func(path string) error {
-			f, err := parser.ParseFile(fset, path, nil, 0)
-			if err != nil {
-				return err
-			}
+		destPkg, err := loadPackage(cfg, fset, ".")
+		if err != nil {
+			return err
+		}
+		destFiles = destPkg.Syntax
+		for _, f := range destFiles {
 			decl := findDecl(f)
 			if len(decl) > 0 {
 				tc = append(tc, &ast.File{
@@ -301,14 +475,9 @@ func RewritePackage(pkgPath string, newPkgPath string, typeMap map[string]Target
 					Name:  f.Name,
 				})
 			}
-			return nil
-		})
-		if err != nil {
-			return err
 		}
 	}
-	conf := types.Config{Importer: importer.Default()}
-	_, err = conf.Check("", fset, tc, nil)
+	_, err = postConf.Check("", fset, tc, nil)
 	if err != nil {
 		for _, f := range tc {
 			printer.Fprint(os.Stderr, fset, f)
@@ -316,6 +485,14 @@ func RewritePackage(pkgPath string, newPkgPath string, typeMap map[string]Target
 		return err
 	}
 
+	// Refuse to emit a package that would not compile: a replacement that
+	// no longer satisfies an interface it was assigned to, or a rewrite
+	// that collides with an existing declaration.
+	conflicts := append(preConflicts, destCollisions(fset, astFiles, destFiles)...)
+	if err := conflictError(conflicts); err != nil {
+		return err
+	}
+
 	if pt.SameDir {
 		for path, f := range files {
 			// Print ast to file.
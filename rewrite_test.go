@@ -0,0 +1,59 @@
+package generic
+
+import (
+	"go/ast"
+	"go/token"
+	"testing"
+)
+
+// TestRewriteIdentEmbeddedField verifies that rewriteIdent renames a
+// placeholder that appears as an embedded struct field (type Wrapper
+// struct { TypeXXX }), not just as a named field type, parameter, or
+// receiver. go/types records such an identifier in both info.Defs (the
+// implicit field *Var it introduces) and info.Uses (the *TypeName it
+// denotes); rewriteIdent must resolve it through Uses first; checking
+// Defs first matched the field Var, which is never in targetObj, so the
+// field was left named TypeXXX after remove-type-decl had already deleted
+// the declaration backing it.
+func TestRewriteIdentEmbeddedField(t *testing.T) {
+	const src = `package p
+
+type TypeXXX int64
+
+type Wrapper struct {
+	TypeXXX
+}
+`
+	fset := token.NewFileSet()
+	file, info := typeCheck(t, fset, src)
+
+	typeMap := map[string]Target{"TypeXXX": {Ident: "Base"}}
+	targetObj := targetObjects([]*ast.File{file}, typeMap, info)
+
+	if !rewriteIdent(file, targetObj, info, fset) {
+		t.Fatal("rewriteIdent() = false, want true")
+	}
+
+	var field *ast.Field
+	for _, decl := range file.Decls {
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range genDecl.Specs {
+			typeSpec := spec.(*ast.TypeSpec)
+			if typeSpec.Name.Name != "Wrapper" {
+				continue
+			}
+			structType := typeSpec.Type.(*ast.StructType)
+			field = structType.Fields.List[0]
+		}
+	}
+	if field == nil {
+		t.Fatal("Wrapper's embedded field not found")
+	}
+	ident := field.Type.(*ast.Ident)
+	if ident.Name != "Base" {
+		t.Errorf("embedded field name = %q, want %q", ident.Name, "Base")
+	}
+}
@@ -0,0 +1,262 @@
+package generic
+
+import (
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// Scope selects which packages RewritePackageTransitive searches for
+// reverse dependencies of the root package.
+type Scope int
+
+const (
+	// ScopeModule loads "./..." with GOWORK=off: the packages of the current
+	// module at or below the working directory. Packages of the module
+	// outside that directory are not searched.
+	ScopeModule Scope = iota
+	// ScopeWorkspace loads "./..." with the current go.work file in effect:
+	// the packages of the workspace's modules at or below the working
+	// directory. Packages outside that directory are not searched.
+	ScopeWorkspace
+	// ScopePatterns searches only TransitiveOptions.Patterns.
+	ScopePatterns
+)
+
+// TransitiveOptions controls RewritePackageTransitive.
+type TransitiveOptions struct {
+	// Scope selects how the reverse-dependency graph is loaded.
+	Scope Scope
+	// Patterns is passed to packages.Load in place of "./..." when Scope is
+	// ScopePatterns.
+	Patterns []string
+	// Rename maps a dependent package's import path to the path its
+	// rewritten copy should be written to. Returning ok == false skips
+	// rewriting that dependency. The root pkgPath/newPkgPath pair passed to
+	// RewritePackageTransitive is handled separately and never reaches
+	// Rename.
+	Rename func(pkgPath string) (newPkgPath string, ok bool)
+}
+
+func (o *TransitiveOptions) patterns() []string {
+	if o.Scope == ScopePatterns {
+		return o.Patterns
+	}
+	return []string{"./..."}
+}
+
+// RewritePackageTransitive rewrites pkgPath into newPkgPath like
+// RewritePackage, then propagates the same typeMap substitution to every
+// package in opts' scope that references one of typeMap's exported
+// placeholder types. The reverse-dependency graph is loaded with
+// golang.org/x/tools/go/packages in a single session (NeedDeps), so every
+// loaded package's TypesInfo shares the same *types.Object identities for
+// cross-package references - root's placeholder types.Object can be
+// compared directly against a dependent's info.Uses without the
+// objectpath indirection a separate load session would need.
+func RewritePackageTransitive(pkgPath string, newPkgPath string, typeMap map[string]Target, opts *TransitiveOptions) error {
+	if opts == nil {
+		opts = &TransitiveOptions{}
+	}
+
+	// Propagation below resolves each dependent package's reference to a
+	// placeholder by substituting the same concrete Target.Ident the root
+	// rewrite used, so it only makes sense for OutputMonomorphized.
+	if err := RewritePackage(pkgPath, newPkgPath, typeMap, nil); err != nil {
+		return err
+	}
+
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedImports | packages.NeedDeps |
+			packages.NeedTypes | packages.NeedTypesInfo | packages.NeedSyntax,
+	}
+	if opts.Scope == ScopeModule {
+		cfg.Env = append(os.Environ(), "GOWORK=off")
+	}
+	pkgs, err := packages.Load(cfg, opts.patterns()...)
+	if err != nil {
+		return err
+	}
+	if packages.PrintErrors(pkgs) > 0 {
+		return fmt.Errorf("generic: errors loading packages for transitive rewrite of %s", pkgPath)
+	}
+
+	root := findPackage(pkgs, pkgPath)
+	if root == nil {
+		// pkgPath isn't reachable from opts' scope (e.g. it lives outside
+		// the module); there is nothing to propagate to.
+		return nil
+	}
+
+	objs := placeholderObjects(root, typeMap)
+	if len(objs) == 0 {
+		return nil
+	}
+
+	if opts.Rename == nil {
+		return fmt.Errorf("generic: TransitiveOptions.Rename is required")
+	}
+
+	var edits []depEdit
+	for _, dep := range reverseDeps(pkgs, root) {
+		edits = append(edits, resolveEdits(dep, objs, typeMap)...)
+	}
+	edits = dedupeEdits(edits)
+
+	byPkg := make(map[*packages.Package][]depEdit)
+	for _, e := range edits {
+		byPkg[e.pkg] = append(byPkg[e.pkg], e)
+	}
+	for dep, depEdits := range byPkg {
+		destPath, ok := opts.Rename(dep.PkgPath)
+		if !ok {
+			continue
+		}
+		if err := writeRewrittenPackage(dep, depEdits, destPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// depEdit is one identifier, in one dependent package, that needs to be
+// renamed to keep up with the root rewrite.
+type depEdit struct {
+	pkg   *packages.Package
+	ident *ast.Ident
+	name  string
+}
+
+// dedupeEdits drops duplicate edits for the same source position. Since
+// token.Pos is unique per (file, offset) within a shared token.FileSet,
+// that is exactly what this deduplicates on.
+func dedupeEdits(edits []depEdit) []depEdit {
+	seen := make(map[token.Pos]bool)
+	out := edits[:0]
+	for _, e := range edits {
+		if seen[e.ident.Pos()] {
+			continue
+		}
+		seen[e.ident.Pos()] = true
+		out = append(out, e)
+	}
+	return out
+}
+
+// findPackage locates pkgPath among pkgs and everything they import.
+func findPackage(pkgs []*packages.Package, pkgPath string) *packages.Package {
+	var found *packages.Package
+	packages.Visit(pkgs, func(p *packages.Package) bool {
+		if p.PkgPath == pkgPath {
+			found = p
+		}
+		return true
+	}, nil)
+	return found
+}
+
+// placeholderObjects looks up each exported typeMap placeholder's
+// types.Object, as declared in root's own package scope. Unexported
+// placeholders are skipped: they cannot be referenced from another
+// package, so they have nothing to propagate.
+func placeholderObjects(root *packages.Package, typeMap map[string]Target) map[string]types.Object {
+	objs := make(map[string]types.Object)
+	scope := root.Types.Scope()
+	for name := range typeMap {
+		obj := scope.Lookup(name)
+		if obj == nil || !obj.Exported() {
+			continue
+		}
+		objs[name] = obj
+	}
+	return objs
+}
+
+// reverseDeps returns every package, loaded transitively from pkgs, that
+// imports root directly - the packages that can name root's placeholder
+// types. A package that reaches root only through another import is not
+// included.
+func reverseDeps(pkgs []*packages.Package, root *packages.Package) []*packages.Package {
+	var all []*packages.Package
+	packages.Visit(pkgs, func(p *packages.Package) bool {
+		all = append(all, p)
+		return true
+	}, nil)
+
+	var deps []*packages.Package
+	for _, p := range all {
+		if p.PkgPath == root.PkgPath {
+			continue
+		}
+		if _, ok := p.Imports[root.PkgPath]; ok {
+			deps = append(deps, p)
+		}
+	}
+	sort.Slice(deps, func(i, j int) bool { return deps[i].PkgPath < deps[j].PkgPath })
+	return deps
+}
+
+// resolveEdits walks dep's syntax for *ast.Ident uses of each placeholder's
+// types.Object. Since objs was looked up from root's scope in the same
+// packages.Load session that produced dep (NeedDeps), dep.TypesInfo.Uses
+// resolves a reference to root's placeholder to that exact same
+// types.Object - no cross-session identity translation (objectpath) is
+// needed.
+func resolveEdits(dep *packages.Package, objs map[string]types.Object, typeMap map[string]Target) []depEdit {
+	var edits []depEdit
+	for key, obj := range objs {
+		to := typeMap[key]
+		for _, f := range dep.Syntax {
+			ast.Inspect(f, func(n ast.Node) bool {
+				ident, ok := n.(*ast.Ident)
+				if !ok {
+					return true
+				}
+				if dep.TypesInfo.Uses[ident] != obj {
+					return true
+				}
+				edits = append(edits, depEdit{pkg: dep, ident: ident, name: to.Ident})
+				return false
+			})
+		}
+	}
+	return edits
+}
+
+// writeRewrittenPackage applies edits to dep's AST and writes the result to
+// destPath, the same way RewritePackage writes a non-same-dir target.
+func writeRewrittenPackage(dep *packages.Package, edits []depEdit, destPath string) error {
+	for _, e := range edits {
+		e.ident.Name = e.name
+	}
+
+	if err := os.RemoveAll(destPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(destPath, 0777); err != nil {
+		return err
+	}
+
+	newName := filepath.Base(destPath)
+	for i, f := range dep.Syntax {
+		rewritePkgName(f, newName)
+
+		dest, err := os.Create(filepath.Join(destPath, filepath.Base(dep.CompiledGoFiles[i])))
+		if err != nil {
+			return err
+		}
+		err = format.Node(dest, dep.Fset, f)
+		dest.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package generic
+
+import (
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// mapImporter resolves import paths from a fixed set of already-checked
+// packages, so a test can wire up two related packages ("a" and a "b" that
+// imports it) without a real module or go/packages.Load.
+type mapImporter map[string]*types.Package
+
+func (m mapImporter) Import(path string) (*types.Package, error) {
+	if pkg, ok := m[path]; ok {
+		return pkg, nil
+	}
+	return nil, fmt.Errorf("package not found: %s", path)
+}
+
+// TestResolveEditsCrossPackage verifies resolveEdits finds a dependent
+// package's reference to a placeholder declared in a different package -
+// the real scenario RewritePackageTransitive propagates to. Regression
+// test for two bugs that only show up with more than one package: an
+// objectpath-based lookup resolved the path against dep.Types rather than
+// the *defining* package's own scope, so it always failed (resolveEdits now
+// compares dep.TypesInfo.Uses against root's objects directly); and
+// RewritePackageTransitive's load Mode must carry packages.NeedTypesInfo,
+// or dep.TypesInfo is nil and resolveEdits panics.
+func TestResolveEditsCrossPackage(t *testing.T) {
+	fset := token.NewFileSet()
+
+	aFile, err := parser.ParseFile(fset, "a.go", `package a
+
+type TypeXXX int
+`, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aInfo := &types.Info{
+		Defs: make(map[*ast.Ident]types.Object),
+		Uses: make(map[*ast.Ident]types.Object),
+	}
+	aConf := types.Config{Importer: importer.Default()}
+	aPkg, err := aConf.Check("q/a", fset, []*ast.File{aFile}, aInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bFile, err := parser.ParseFile(fset, "b.go", `package b
+
+import "q/a"
+
+func Use(v a.TypeXXX) {}
+`, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bInfo := &types.Info{
+		Defs: make(map[*ast.Ident]types.Object),
+		Uses: make(map[*ast.Ident]types.Object),
+	}
+	bConf := types.Config{Importer: mapImporter{"q/a": aPkg}}
+	bPkg, err := bConf.Check("q/b", fset, []*ast.File{bFile}, bInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := &packages.Package{PkgPath: "q/a", Types: aPkg, Syntax: []*ast.File{aFile}}
+	dep := &packages.Package{PkgPath: "q/b", Types: bPkg, TypesInfo: bInfo, Syntax: []*ast.File{bFile}}
+
+	typeMap := map[string]Target{"TypeXXX": {Ident: "int64"}}
+	objs := placeholderObjects(root, typeMap)
+	if len(objs) != 1 {
+		t.Fatalf("placeholderObjects() = %v, want exactly 1 entry", objs)
+	}
+
+	edits := resolveEdits(dep, objs, typeMap)
+	if len(edits) != 1 {
+		t.Fatalf("resolveEdits() = %v, want exactly 1 edit for b's a.TypeXXX reference", edits)
+	}
+	if edits[0].name != "int64" {
+		t.Errorf("edits[0].name = %q, want %q", edits[0].name, "int64")
+	}
+}